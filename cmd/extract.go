@@ -28,23 +28,26 @@ import (
 	"strings"
 	"text/template"
 
-	bolt "github.com/coreos/bbolt"
 	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/jpbetz/auger/pkg/encoding"
+	"github.com/jpbetz/auger/pkg/encryption"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 var (
 	extractLong = `
-Extracts kubernetes data stored by etcd into boltdb '.db' files.
+Extracts kubernetes data stored by etcd into boltdb '.db' files, or from a
+live etcd cluster.
 
 May be used both to inspect the contents of a botldb file and to
 extract specific data entries. Data may be looked up either by etcd
 key and version, or by bolt page and item coordinates.
 
-Etcd must stopped when using this tool, or it will wait indefinitely
-for the '.db' file lock.`
+When reading a boltdb file, etcd must be stopped, or this tool will wait
+indefinitely for the '.db' file lock. Pass --endpoints to instead read
+from a live etcd cluster over its gRPC API, with no need to stop etcd.`
 
 	extractExample = `
         # Find an etcd value by it's key and extract it from a boltdb file:
@@ -61,6 +64,9 @@ for the '.db' file lock.`
 
         # Extract the etcd key stored in page 10, item 0 of a boltdb file:
         bolt page --item 0 --value-only <boltdb-file> 10 | auger extract --leaf-item --print-key
+
+        # Find an etcd value by it's key from a live etcd cluster, without stopping etcd:
+        auger extract --endpoints https://127.0.0.1:2379 --cacert <ca.crt> --cert <etcd.crt> --tls-key <etcd.key> -k /registry/pods/default/<pod-name>
 `
 )
 
@@ -75,18 +81,26 @@ var extractCmd = &cobra.Command{
 }
 
 type extractOptions struct {
-	out          string
-	filename     string
-	key          string
-	version      string
-	keyPrefix    string
-	listVersions bool
-	leafItem     bool
-	printKey     bool
-	metaSummary  bool
-	raw          bool
-	fields       string
-	template     string
+	out                     string
+	filename                string
+	key                     string
+	version                 string
+	keyPrefix               string
+	listVersions            bool
+	leafItem                bool
+	printKey                bool
+	metaSummary             bool
+	raw                     bool
+	fields                  string
+	template                string
+	encryptionConfig        string
+	printEncryptionProvider bool
+	endpoints               []string
+	cacert                  string
+	cert                    string
+	tlsKey                  string
+	etcdPrefix              string
+	convertTo               string
 }
 
 var opts *extractOptions = &extractOptions{}
@@ -105,6 +119,15 @@ func init() {
 	extractCmd.Flags().BoolVar(&opts.raw, "raw", false, "Don't attempt to decode the etcd value")
 	extractCmd.Flags().StringVar(&opts.fields, "fields", Key, fmt.Sprintf("Fields to include when listing entries, comma separated list of: %v", SummaryFields))
 	extractCmd.Flags().StringVar(&opts.template, "template", "", fmt.Sprintf("golang template to use when listing entries, see https://golang.org/pkg/text/template, template is provided an object with the fields: %v. The Value field contains the entire kubernetes resource object which also may be dereferenced using a dot seperated path.", templateFields()))
+	extractCmd.Flags().StringVar(&opts.encryptionConfig, "encryption-config", "", "Path to the apiserver.config.k8s.io/v1 EncryptionConfiguration file used to decrypt values wrapped by a k8s:enc: encryption-at-rest provider")
+	extractCmd.Flags().BoolVar(&opts.printEncryptionProvider, "print-encryption-provider", false, "Print the encryption provider and key name guarding each entry instead of its value, requires --encryption-config")
+	extractCmd.Flags().StringSliceVar(&opts.endpoints, "endpoints", nil, "etcd gRPC endpoints to read from instead of a boltdb file, e.g. https://127.0.0.1:2379. When set, --file is ignored and etcd does not need to be stopped")
+	extractCmd.Flags().StringVar(&opts.cacert, "cacert", "", "Etcd CA certificate, used with --endpoints")
+	extractCmd.Flags().StringVar(&opts.cert, "cert", "", "Etcd client certificate, used with --endpoints")
+	// Note: --key is already taken by the etcd object key lookup flag above, so the client key file uses --tls-key.
+	extractCmd.Flags().StringVar(&opts.tlsKey, "tls-key", "", "Etcd client key, used with --endpoints")
+	extractCmd.Flags().StringVar(&opts.etcdPrefix, "etcd-prefix", "/registry", "Key prefix kubernetes stores its data under, used as the default --keys-by-prefix when reading from --endpoints")
+	extractCmd.Flags().StringVar(&opts.convertTo, "convert-to", "", "Group/version to convert the decoded object to before printing, e.g. apps/v1. pkg/encoding.Scheme registers no conversions between API versions, so only the version the object was stored as can be emitted; any other group/version is rejected with an error, see that package's doc comment. Defaults to the version the object was stored as")
 }
 
 const (
@@ -126,9 +149,6 @@ func templateFields() string {
 	return strings.Join(names, ", ")
 }
 
-// See etcd/mvcc/kvstore.go:keyBucketName
-var keyBucket = []byte("key")
-
 func extractValidateAndRun() error {
 	outMediaType, err := encoding.ToMediaType(opts.out)
 	if err != nil {
@@ -141,7 +161,39 @@ func extractValidateAndRun() error {
 	hasFields := opts.fields != Key
 	hasTemplate := opts.template != ""
 
+	var encryptionCfg *encryption.Config
+	if opts.encryptionConfig != "" {
+		encryptionCfg, err = encryption.LoadConfig(opts.encryptionConfig)
+		if err != nil {
+			return err
+		}
+	} else if opts.printEncryptionProvider {
+		return fmt.Errorf("--print-encryption-provider requires --encryption-config")
+	}
+
+	var convertTo *schema.GroupVersion
+	if opts.convertTo != "" {
+		gv, err := schema.ParseGroupVersion(opts.convertTo)
+		if err != nil {
+			return fmt.Errorf("invalid --convert-to %s: %s", opts.convertTo, err)
+		}
+		convertTo = &gv
+	}
+
+	var store Store
+	if !opts.leafItem {
+		store, err = newStore(opts)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+	}
+
 	switch {
+	case opts.printEncryptionProvider && hasKey:
+		return printEncryptionProvider(store, opts.key, opts.version, out)
+	case opts.printEncryptionProvider:
+		return printEncryptionProviders(store, opts.keyPrefix, out)
 	case opts.leafItem:
 		raw, err := readInput(opts.filename)
 		if err != nil {
@@ -156,14 +208,14 @@ func extractValidateAndRun() error {
 		} else if opts.printKey {
 			return printLeafItemKey(kv, out)
 		} else {
-			return printLeafItemValue(kv, outMediaType, out)
+			return printLeafItemValue(kv, outMediaType, out, encryptionCfg, convertTo)
 		}
 	case hasKey && hasKeyPrefix:
 		return fmt.Errorf("--keys-by-prefix and --key may not be used together")
 	case hasKey && opts.listVersions:
-		return printVersions(opts.filename, opts.key, out)
+		return printVersions(store, opts.key, out)
 	case hasKey:
-		return printValue(opts.filename, opts.key, opts.version, opts.raw, outMediaType, out)
+		return printValue(store, opts.key, opts.version, opts.raw, outMediaType, out, encryptionCfg, convertTo)
 	case !hasKey && opts.listVersions:
 		return fmt.Errorf("--list-versions may only be used with --key")
 	case !hasKey && hasVersion:
@@ -171,16 +223,16 @@ func extractValidateAndRun() error {
 	case hasTemplate && hasFields:
 		return fmt.Errorf("--template and --fields may not be used together")
 	case hasTemplate:
-		return templateSummaries(opts.filename, opts.keyPrefix, opts.template, out)
+		return templateSummaries(store, opts.keyPrefix, opts.template, out, encryptionCfg)
 	default:
 		fields := strings.Split(opts.fields, ",")
-		return printKeySummaries(opts.filename, opts.keyPrefix, fields, out)
+		return printKeySummaries(store, opts.keyPrefix, fields, out, encryptionCfg)
 	}
 }
 
 // printVersions writes all versions of the given key.
-func printVersions(filename string, key string, out io.Writer) error {
-	versions, err := listVersions(filename, key)
+func printVersions(store Store, key string, out io.Writer) error {
+	versions, err := store.ListVersions(key)
 	if err != nil {
 		return err
 	}
@@ -191,11 +243,11 @@ func printVersions(filename string, key string, out io.Writer) error {
 }
 
 // printValue writes the value, in the desired media type, of the given key version.
-func printValue(filename string, key string, version string, raw bool, outMediaType string, out io.Writer) error {
+func printValue(store Store, key string, version string, raw bool, outMediaType string, out io.Writer, encryptionCfg *encryption.Config, convertTo *schema.GroupVersion) error {
 	var v int64
 	var err error
 	if version == "" {
-		versions, err := listVersions(filename, key)
+		versions, err := store.ListVersions(key)
 		if err != nil {
 			return err
 		}
@@ -210,7 +262,7 @@ func printValue(filename string, key string, version string, raw bool, outMediaT
 			return fmt.Errorf("version must be an int64, but got %s: %s", version, err)
 		}
 	}
-	in, err := getValue(filename, key, v)
+	in, err := store.GetValue(key, v)
 	if err != nil {
 		return err
 	}
@@ -221,7 +273,7 @@ func printValue(filename string, key string, version string, raw bool, outMediaT
 		fmt.Fprintf(out, "%s\n", string(in))
 		return nil
 	}
-	_, err = convert(outMediaType, in, out)
+	_, err = convert(outMediaType, in, out, encryptionCfg, convertTo)
 	return err
 }
 
@@ -242,18 +294,91 @@ func printLeafItemSummary(kv *mvccpb.KeyValue, out io.Writer) error {
 }
 
 // printLeafItemValue prints an etcd value for a given boltdb leaf item.
-func printLeafItemValue(kv *mvccpb.KeyValue, outMediaType string, out io.Writer) error {
-	_, err := convert(outMediaType, kv.Value, out)
+func printLeafItemValue(kv *mvccpb.KeyValue, outMediaType string, out io.Writer, encryptionCfg *encryption.Config, convertTo *schema.GroupVersion) error {
+	_, err := convert(outMediaType, kv.Value, out, encryptionCfg, convertTo)
 	return err
 }
 
+// printEncryptionProvider prints the provider and key name guarding the given key version.
+func printEncryptionProvider(store Store, key string, version string, out io.Writer) error {
+	var v int64
+	var err error
+	if version == "" {
+		versions, err := store.ListVersions(key)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("No versions found for key: %s", key)
+		}
+		v = maxInSlice(versions)
+	} else {
+		v, err = strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return fmt.Errorf("version must be an int64, but got %s: %s", version, err)
+		}
+	}
+	in, err := store.GetValue(key, v)
+	if err != nil {
+		return err
+	}
+	return printEncryptionProviderLine(key, in, out)
+}
+
+// printEncryptionProviders prints the provider and key name guarding the
+// current value of every key with the given prefix.
+func printEncryptionProviders(store Store, keyPrefix string, out io.Writer) error {
+	latest := map[string]*mvccpb.KeyValue{}
+	err := store.Walk(keyPrefix, func(kv *mvccpb.KeyValue) (bool, error) {
+		// boltStore.Walk visits every stored revision of a key in ascending
+		// revision order, so the first one seen is its oldest revision, not
+		// its current one; keep whichever has the highest Version, the same
+		// way listKeySummaries does.
+		if cur, ok := latest[string(kv.Key)]; !ok || kv.Version > cur.Version {
+			latest[string(kv.Key)] = kv
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(latest))
+	for key := range latest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := printEncryptionProviderLine(key, latest[key].Value, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printEncryptionProviderLine(key string, value []byte, out io.Writer) error {
+	if !encryption.IsEncrypted(value) {
+		fmt.Fprintf(out, "%s none\n", key)
+		return nil
+	}
+	provider, keyName, err := encryption.ProviderAndKeyName(value)
+	if err != nil {
+		return err
+	}
+	if keyName == "" {
+		fmt.Fprintf(out, "%s %s\n", key, provider)
+	} else {
+		fmt.Fprintf(out, "%s %s:%s\n", key, provider, keyName)
+	}
+	return nil
+}
+
 // printKeySummaries prints all keys in the db file with the given key prefix.
-func printKeySummaries(filename string, keyPrefix string, fields []string, out io.Writer) error {
+func printKeySummaries(store Store, keyPrefix string, fields []string, out io.Writer, encryptionCfg *encryption.Config) error {
 	if len(fields) == 0 {
 		return fmt.Errorf("no fields provided, nothing to output.")
 	}
 
-	summaries, err := listKeySummaries(filename, keyPrefix)
+	summaries, err := listKeySummaries(store, keyPrefix, encryptionCfg)
 	if err != nil {
 		return err
 	}
@@ -269,7 +394,7 @@ func printKeySummaries(filename string, keyPrefix string, fields []string, out i
 
 // templateSummaries prints out each KeySummary according to the given golang template.
 // See https://golang.org/pkg/text/template for details on the template format.
-func templateSummaries(filename string, keyPrefix string, templatestr string, out io.Writer) error {
+func templateSummaries(store Store, keyPrefix string, templatestr string, out io.Writer, encryptionCfg *encryption.Config) error {
 	t, err := template.New("template").Parse(templatestr)
 	if err != nil {
 		return err
@@ -279,7 +404,7 @@ func templateSummaries(filename string, keyPrefix string, templatestr string, ou
 		return fmt.Errorf("no template provided, nothing to output.")
 	}
 
-	summaries, err := listKeySummaries(filename, keyPrefix)
+	summaries, err := listKeySummaries(store, keyPrefix, encryptionCfg)
 	if err != nil {
 		return err
 	}
@@ -293,11 +418,24 @@ func templateSummaries(filename string, keyPrefix string, templatestr string, ou
 	return nil
 }
 
-func convert(outMediaType string, in []byte, out io.Writer) (*runtime.TypeMeta, error) {
+func convert(outMediaType string, in []byte, out io.Writer, encryptionCfg *encryption.Config, convertTo *schema.GroupVersion) (*runtime.TypeMeta, error) {
+	if encryption.IsEncrypted(in) {
+		if encryptionCfg == nil {
+			return nil, fmt.Errorf("value is encrypted by a k8s:enc: provider, pass --encryption-config to decrypt it")
+		}
+		decrypted, err := encryptionCfg.Decrypt(in)
+		if err != nil {
+			return nil, err
+		}
+		in = decrypted
+	}
 	inMediaType, in, err := encoding.DetectAndExtract(in)
 	if err != nil {
 		return nil, err
 	}
+	if convertTo != nil {
+		return encoding.ConvertTo(inMediaType, outMediaType, *convertTo, in, out)
+	}
 	return encoding.Convert(inMediaType, outMediaType, in, out)
 }
 
@@ -338,44 +476,40 @@ func (s *KeySummary) summarize(fields []string) (string, error) {
 	return strings.Join(values, " "), nil
 }
 
-func listKeySummaries(filename string, prefix string) ([]*KeySummary, error) {
-	prefixBytes := []byte(prefix)
+func listKeySummaries(store Store, prefix string, encryptionCfg *encryption.Config) ([]*KeySummary, error) {
 	m := make(map[string]*KeySummary)
-	err := walk(filename, func(kv *mvccpb.KeyValue) (bool, error) {
-		if bytes.HasPrefix(kv.Key, prefixBytes) {
-			ks, ok := m[string(kv.Key)]
-			if !ok {
-				buf := new(bytes.Buffer)
-				var valJson string
-				var typeMeta *runtime.TypeMeta
-				var err error
-				if typeMeta, err = convert(encoding.JsonMediaType, kv.Value, buf); err == nil {
-					valJson = strings.TrimSpace(buf.String())
-				}
-				ks = &KeySummary{
-					Key:     string(kv.Key),
-					Version: kv.Version,
-					Stats: &KeySummaryStats{
-						KeySize:              len(kv.Key),
-						ValueSize:            len(kv.Value),
-						AllVersionsKeySize:   len(kv.Key),
-						AllVersionsValueSize: len(kv.Value),
-						VersionCount:         1,
-					},
-					Value:    rawJsonUnmarshal(valJson),
-					TypeMeta: typeMeta,
-				}
-				m[string(kv.Key)] = ks
-			} else {
-				if kv.Version > ks.Version {
-					ks.Version = kv.Version
-					ks.Stats.ValueSize = len(kv.Value)
-				}
-				ks.Stats.VersionCount += 1
-				ks.Stats.AllVersionsKeySize += len(kv.Key)
-				ks.Stats.AllVersionsValueSize += len(kv.Value)
+	err := store.Walk(prefix, func(kv *mvccpb.KeyValue) (bool, error) {
+		ks, ok := m[string(kv.Key)]
+		if !ok {
+			buf := new(bytes.Buffer)
+			var valJson string
+			var typeMeta *runtime.TypeMeta
+			var err error
+			if typeMeta, err = convert(encoding.JsonMediaType, kv.Value, buf, encryptionCfg, nil); err == nil {
+				valJson = strings.TrimSpace(buf.String())
 			}
-
+			ks = &KeySummary{
+				Key:     string(kv.Key),
+				Version: kv.Version,
+				Stats: &KeySummaryStats{
+					KeySize:              len(kv.Key),
+					ValueSize:            len(kv.Value),
+					AllVersionsKeySize:   len(kv.Key),
+					AllVersionsValueSize: len(kv.Value),
+					VersionCount:         1,
+				},
+				Value:    rawJsonUnmarshal(valJson),
+				TypeMeta: typeMeta,
+			}
+			m[string(kv.Key)] = ks
+		} else {
+			if kv.Version > ks.Version {
+				ks.Version = kv.Version
+				ks.Stats.ValueSize = len(kv.Value)
+			}
+			ks.Stats.VersionCount += 1
+			ks.Stats.AllVersionsKeySize += len(kv.Key)
+			ks.Stats.AllVersionsValueSize += len(kv.Value)
 		}
 		return false, nil
 	})
@@ -386,76 +520,6 @@ func listKeySummaries(filename string, prefix string) ([]*KeySummary, error) {
 	return result, nil
 }
 
-func listVersions(filename string, key string) ([]int64, error) {
-	var result []int64
-
-	err := walk(filename, func(kv *mvccpb.KeyValue) (bool, error) {
-		if string(kv.Key) == key {
-			result = append(result, kv.Version)
-		}
-		return false, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	return result, nil
-}
-
-// getValue scans the bucket of the bolt db file for a etcd v3 record with the given key and returns the value.
-// Because bolt db files are indexed by revision
-func getValue(filename string, key string, version int64) ([]byte, error) {
-	var result []byte
-	found := false
-	err := walk(filename, func(kv *mvccpb.KeyValue) (bool, error) {
-		if string(kv.Key) == key && kv.Version == version {
-			result = kv.Value
-			found = true
-			return true, nil
-		}
-		return false, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	if !found {
-		return nil, fmt.Errorf("key not found: %s", key)
-	}
-	return result, nil
-}
-
-func walk(filename string, f func(kv *mvccpb.KeyValue) (bool, error)) error {
-	db, err := bolt.Open(filename, 0400, &bolt.Options{})
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(keyBucket)
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			kv := &mvccpb.KeyValue{}
-			err = kv.Unmarshal(v)
-			if err != nil {
-				return err
-			}
-			done, err := f(kv)
-			if err != nil {
-				return fmt.Errorf("Error handling key %s", kv.Key)
-			}
-			if done {
-				break
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func extractKvFromLeafItem(raw []byte) (*mvccpb.KeyValue, error) {
 	kv := &mvccpb.KeyValue{}
 	err := kv.Unmarshal(raw)
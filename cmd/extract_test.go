@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// newTestBoltStore writes kvs into a fresh boltdb "key" bucket, one entry
+// per revToBytes(kv.ModRevision, 0), alongside an empty "meta" bucket, and
+// returns a boltStore reading it back, the same layout etcd itself uses.
+func newTestBoltStore(t *testing.T, kvs ...*mvccpb.KeyValue) *boltStore {
+	t.Helper()
+	filename := t.TempDir() + "/test.db"
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(keyBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			data, err := kv.Marshal()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(revToBytes(kv.ModRevision, 0), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &boltStore{filename: filename}
+}
+
+func TestPrintEncryptionProvidersReportsLatestVersion(t *testing.T) {
+	store := newTestBoltStore(t,
+		// Key rotated from aescbc/key1 to aescbc/key2; the current value
+		// (the higher ModRevision/Version) is guarded by key2.
+		&mvccpb.KeyValue{
+			Key:         []byte("/registry/secrets/default/foo"),
+			ModRevision: 1,
+			Version:     1,
+			Value:       []byte("k8s:enc:aescbc:v1:key1:ciphertext-v1"),
+		},
+		&mvccpb.KeyValue{
+			Key:         []byte("/registry/secrets/default/foo"),
+			ModRevision: 2,
+			Version:     2,
+			Value:       []byte("k8s:enc:aescbc:v1:key2:ciphertext-v2"),
+		},
+		&mvccpb.KeyValue{
+			Key:         []byte("/registry/secrets/default/bar"),
+			ModRevision: 3,
+			Version:     1,
+			Value:       []byte("k8s:enc:identity:v1:"),
+		},
+	)
+
+	out := new(bytes.Buffer)
+	if err := printEncryptionProviders(store, "", out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "/registry/secrets/default/bar identity\n" +
+		"/registry/secrets/default/foo aescbc:key2\n"
+	if out.String() != want {
+		t.Errorf("printEncryptionProviders output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
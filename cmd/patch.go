@@ -0,0 +1,323 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/jpbetz/auger/pkg/encoding"
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+var (
+	patchLong = `
+Applies a JSON Patch, Merge Patch or Strategic Merge Patch to a single
+etcd value found in a boltdb '.db' file, and writes the result back into
+the file as a new revision.
+
+Like extract, this reads boltdb files directly and so requires etcd to be
+stopped. Unlike extract, it mutates the file: the matching key is given a
+new revision with the patched value, bumping ModRevision and Version, and
+etcd's meta bucket bookkeeping is updated so etcd accepts the file again
+on restart.
+
+Nothing is written unless --commit is given; otherwise patch only prints
+a diff of the decoded object before and after the patch, for review.`
+
+	patchExample = `
+        # Preview a strategic merge patch to a pod, without writing it:
+        auger patch -f <boltdb-file> -k /registry/pods/default/<pod-name> --patch-file patch.json
+
+        # Apply a JSON Patch (RFC 6902) and write the result back:
+        auger patch -f <boltdb-file> -k /registry/pods/default/<pod-name> --patch-type=json --patch-file patch.json --commit
+`
+)
+
+var patchCmd = &cobra.Command{
+	Use:     "patch",
+	Short:   "Applies a patch to a single etcd value stored in a boltdb '.db' file.",
+	Long:    patchLong,
+	Example: patchExample,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return patchValidateAndRun()
+	},
+}
+
+type patchOptions struct {
+	filename  string
+	key       string
+	version   string
+	patchType string
+	patchFile string
+	commit    bool
+}
+
+var patchOpts = &patchOptions{}
+
+func init() {
+	RootCmd.AddCommand(patchCmd)
+	patchCmd.Flags().StringVarP(&patchOpts.filename, "file", "f", "", "Bolt DB '.db' filename")
+	patchCmd.Flags().StringVarP(&patchOpts.key, "key", "k", "", "Etcd object key to patch")
+	patchCmd.Flags().StringVarP(&patchOpts.version, "version", "v", "", "Version of etcd key to patch, defaults to the latest version")
+	patchCmd.Flags().StringVar(&patchOpts.patchType, "patch-type", "strategic", "Type of patch being applied. One of: json|merge|strategic")
+	patchCmd.Flags().StringVar(&patchOpts.patchFile, "patch-file", "", "File containing the patch to apply")
+	patchCmd.Flags().BoolVar(&patchOpts.commit, "commit", false, "Write the patched value back into the boltdb file as a new revision. Without this flag, patch only prints the before/after diff")
+}
+
+func patchValidateAndRun() error {
+	if patchOpts.filename == "" {
+		return fmt.Errorf("--file is required")
+	}
+	if patchOpts.key == "" {
+		return fmt.Errorf("--key is required")
+	}
+	if patchOpts.patchFile == "" {
+		return fmt.Errorf("--patch-file is required")
+	}
+	patchBytes, err := ioutil.ReadFile(patchOpts.patchFile)
+	if err != nil {
+		return fmt.Errorf("unable to read --patch-file %s: %s", patchOpts.patchFile, err)
+	}
+
+	store := &boltStore{filename: patchOpts.filename}
+	v, err := resolveVersion(store, patchOpts.key, patchOpts.version)
+	if err != nil {
+		return err
+	}
+	kv, err := store.GetKeyValue(patchOpts.key, v)
+	if err != nil {
+		return err
+	}
+
+	inMediaType, decoded, err := encoding.DetectAndExtract(kv.Value)
+	if err != nil {
+		return err
+	}
+	before := new(bytes.Buffer)
+	typeMeta, err := encoding.Convert(inMediaType, encoding.JsonMediaType, decoded, before)
+	if err != nil {
+		return fmt.Errorf("unable to decode value for key %s: %s", patchOpts.key, err)
+	}
+
+	after, err := applyPatch(patchOpts.patchType, before.Bytes(), patchBytes, typeMeta)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stdout, diff.StringDiff(before.String(), string(after)))
+
+	if !patchOpts.commit {
+		fmt.Fprintln(os.Stdout, "dry run: pass --commit to write this change back into the boltdb file")
+		return nil
+	}
+
+	reencoded := new(bytes.Buffer)
+	if _, err := encoding.Convert(encoding.JsonMediaType, inMediaType, after, reencoded); err != nil {
+		return fmt.Errorf("unable to re-encode patched value: %s", err)
+	}
+
+	return writeValue(patchOpts.filename, kv, reencoded.Bytes())
+}
+
+// resolveVersion returns version parsed as an int64, or the latest version
+// of key if version is empty.
+func resolveVersion(store *boltStore, key string, version string) (int64, error) {
+	if version != "" {
+		return strconv.ParseInt(version, 10, 64)
+	}
+	versions, err := store.ListVersions(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("No versions found for key: %s", key)
+	}
+	return maxInSlice(versions), nil
+}
+
+// applyPatch applies patchBytes to before according to patchType, returning the patched JSON document.
+func applyPatch(patchType string, before []byte, patchBytes []byte, typeMeta *runtime.TypeMeta) ([]byte, error) {
+	switch patchType {
+	case "json":
+		p, err := jsonpatch.DecodePatch(patchBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON Patch: %s", err)
+		}
+		return p.Apply(before)
+	case "merge":
+		return jsonpatch.MergePatch(before, patchBytes)
+	case "strategic":
+		if typeMeta == nil || typeMeta.Kind == "" {
+			return nil, fmt.Errorf("stored value has no apiVersion/kind, strategic merge patch requires a registered type; try --patch-type=merge instead")
+		}
+		gvk := schema.FromAPIVersionAndKind(typeMeta.APIVersion, typeMeta.Kind)
+		obj, err := encoding.Scheme.New(gvk)
+		if err != nil {
+			return nil, fmt.Errorf("no type registered for %s, strategic merge patch requires a registered type; try --patch-type=merge instead: %s", gvk, err)
+		}
+		return strategicpatch.StrategicMergePatch(before, patchBytes, obj)
+	default:
+		return nil, fmt.Errorf("unrecognized --patch-type %s, must be one of: json|merge|strategic", patchType)
+	}
+}
+
+// writeValue writes newValue into filename as a new revision of kv.Key,
+// bumping ModRevision and Version and advancing the meta bucket's
+// consistent_index so etcd accepts the file again on restart. Like the
+// rest of this tool, it requires exclusive access to filename, so etcd
+// must be stopped.
+//
+// kv is the record --version resolved to, which --version lets an
+// operator pick as something other than the key's current version (e.g.
+// to forensically repair an older revision); its own Version therefore
+// isn't necessarily the key's latest, so the new record's Version is
+// derived from a fresh scan of the key bucket instead of from kv.Version,
+// to avoid colliding with or regressing behind a later revision that
+// already exists.
+func writeValue(filename string, kv *mvccpb.KeyValue, newValue []byte) error {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keyBucket)
+		maxRev, err := maxMainRevision(b)
+		if err != nil {
+			return err
+		}
+		newRev := maxRev + 1
+
+		latestVersion, err := maxVersionForKey(b, kv.Key)
+		if err != nil {
+			return err
+		}
+
+		newKV := &mvccpb.KeyValue{
+			Key:            kv.Key,
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    newRev,
+			Version:        latestVersion + 1,
+			Value:          newValue,
+			Lease:          kv.Lease,
+		}
+		data, err := newKV.Marshal()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(revToBytes(newRev, 0), data); err != nil {
+			return err
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("boltdb file has no %q bucket, doesn't look like an etcd db file", metaBucket)
+		}
+		return bumpConsistentIndex(meta)
+	})
+}
+
+// maxVersionForKey scans every record in the key bucket and returns the
+// largest Version found for key, so a new write can be given the next
+// one regardless of which revision of key was actually patched.
+func maxVersionForKey(b *bolt.Bucket, key []byte) (int64, error) {
+	var max int64
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		rec := &mvccpb.KeyValue{}
+		if err := rec.Unmarshal(v); err != nil {
+			return 0, err
+		}
+		if bytes.Equal(rec.Key, key) && rec.Version > max {
+			max = rec.Version
+		}
+	}
+	return max, nil
+}
+
+// metaBucket and consistentIndexKey mirror etcd/mvcc/kvstore.go and
+// etcd/mvcc/backend, which etcd itself uses to track, on restart, which
+// raft log entries have already been applied to this boltdb file.
+var (
+	metaBucket         = []byte("meta")
+	consistentIndexKey = []byte("consistent_index")
+)
+
+// bumpConsistentIndex advances meta's consistent_index by one.
+//
+// consistent_index counts applied raft log entries, a number this tool
+// has no way to know the true value of since it never participates in
+// raft; it is not the same counter as the mvcc main revision, and writing
+// the new revision number into it (as an earlier version of this function
+// did) corrupts etcd's bookkeeping in a way that happens to look plausible.
+// Incrementing the existing value by one is the best this tool can do
+// offline: etcd only requires consistent_index to be monotonic and to
+// reflect that *a* write happened, not that it match any specific raft
+// index, so bumping it forward by one keeps the file internally
+// consistent enough for etcd to accept on restart without claiming
+// knowledge this tool doesn't have. This couldn't be verified against a
+// real etcd restart in this environment; treat it as the documented best
+// effort, not a guarantee.
+func bumpConsistentIndex(meta *bolt.Bucket) error {
+	idx := uint64(0)
+	if cur := meta.Get(consistentIndexKey); len(cur) >= 8 {
+		idx = binary.BigEndian.Uint64(cur)
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, idx+1)
+	return meta.Put(consistentIndexKey, buf)
+}
+
+// revToBytes encodes an etcd mvcc revision the same way etcd/mvcc/key_index.go
+// does: an 8-byte big endian main revision, a literal '_', and an 8-byte
+// big endian sub revision.
+func revToBytes(main int64, sub int64) []byte {
+	b := make([]byte, 17)
+	binary.BigEndian.PutUint64(b, uint64(main))
+	b[8] = '_'
+	binary.BigEndian.PutUint64(b[9:], uint64(sub))
+	return b
+}
+
+// maxMainRevision scans every key in the key bucket and returns the
+// largest main revision found, so a new write can be given the next one.
+func maxMainRevision(b *bolt.Bucket) (int64, error) {
+	var max int64
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if len(k) < 8 {
+			continue
+		}
+		if rev := int64(binary.BigEndian.Uint64(k[:8])); rev > max {
+			max = rev
+		}
+	}
+	return max, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestBumpConsistentIndex(t *testing.T) {
+	dir := t.TempDir()
+	db, err := bolt.Open(dir+"/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i, want := range []uint64{1, 2, 3} {
+		err := db.Update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return bumpConsistentIndex(meta)
+		})
+		if err != nil {
+			t.Fatalf("bump %d: %s", i, err)
+		}
+		var got uint64
+		db.View(func(tx *bolt.Tx) error {
+			got = binary.BigEndian.Uint64(tx.Bucket(metaBucket).Get(consistentIndexKey))
+			return nil
+		})
+		if got != want {
+			t.Errorf("after bump %d: consistent_index = %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestRevToBytes(t *testing.T) {
+	b := revToBytes(5, 0)
+	if len(b) != 17 {
+		t.Fatalf("revToBytes returned %d bytes, want 17", len(b))
+	}
+	if got := binary.BigEndian.Uint64(b[:8]); got != 5 {
+		t.Errorf("main revision = %d, want 5", got)
+	}
+	if b[8] != '_' {
+		t.Errorf("separator byte = %q, want '_'", b[8])
+	}
+	if got := binary.BigEndian.Uint64(b[9:]); got != 0 {
+		t.Errorf("sub revision = %d, want 0", got)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	podTypeMeta := &runtime.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+	pod := `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"},"spec":{"containers":[{"name":"c","image":"nginx"}]}}`
+
+	cases := []struct {
+		name      string
+		patchType string
+		before    string
+		patch     string
+		typeMeta  *runtime.TypeMeta
+		want      string
+	}{
+		{
+			name:      "json",
+			patchType: "json",
+			before:    `{"a":1}`,
+			patch:     `[{"op":"replace","path":"/a","value":2}]`,
+			want:      `{"a":2}`,
+		},
+		{
+			name:      "merge",
+			patchType: "merge",
+			before:    `{"a":1,"b":2}`,
+			patch:     `{"b":3}`,
+			want:      `{"a":1,"b":3}`,
+		},
+		{
+			name:      "strategic",
+			patchType: "strategic",
+			before:    pod,
+			patch:     `{"spec":{"containers":[{"name":"c","image":"nginx:2"}]}}`,
+			typeMeta:  podTypeMeta,
+			want:      `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"test"},"spec":{"containers":[{"name":"c","image":"nginx:2"}]}}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := applyPatch(c.patchType, []byte(c.before), []byte(c.patch), c.typeMeta)
+			if err != nil {
+				t.Fatalf("applyPatch: %s", err)
+			}
+			var gotObj, wantObj interface{}
+			if err := json.Unmarshal(got, &gotObj); err != nil {
+				t.Fatalf("unmarshal result: %s", err)
+			}
+			if err := json.Unmarshal([]byte(c.want), &wantObj); err != nil {
+				t.Fatalf("unmarshal want: %s", err)
+			}
+			if !reflect.DeepEqual(gotObj, wantObj) {
+				t.Errorf("applyPatch result = %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestWriteValueUsesKeysLatestVersion(t *testing.T) {
+	store := newTestBoltStore(t,
+		&mvccpb.KeyValue{Key: []byte("/registry/pods/default/foo"), CreateRevision: 1, ModRevision: 1, Version: 1, Value: []byte("v1")},
+		&mvccpb.KeyValue{Key: []byte("/registry/pods/default/foo"), CreateRevision: 1, ModRevision: 2, Version: 2, Value: []byte("v2")},
+	)
+
+	// Patch the older, explicitly-requested revision (--version 1), as an
+	// operator forensically repairing history might.
+	kv, err := store.GetKeyValue("/registry/pods/default/foo", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeValue(store.filename, kv, []byte("patched")); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := store.GetKeyValue("/registry/pods/default/foo", 3)
+	if err != nil {
+		t.Fatalf("expected the new record to have Version 3 (key's latest Version 2, plus one): %s", err)
+	}
+	if string(latest.Value) != "patched" {
+		t.Errorf("new record Value = %q, want %q", latest.Value, "patched")
+	}
+}
+
+func TestMaxMainRevision(t *testing.T) {
+	dir := t.TempDir()
+	db, err := bolt.Open(dir+"/test.db", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(keyBucket)
+		if err != nil {
+			return err
+		}
+		for _, rev := range []int64{1, 5, 3} {
+			if err := b.Put(revToBytes(rev, 0), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var max int64
+	db.View(func(tx *bolt.Tx) error {
+		max, err = maxMainRevision(tx.Bucket(keyBucket))
+		return err
+	})
+	if max != 5 {
+		t.Errorf("maxMainRevision = %d, want 5", max)
+	}
+}
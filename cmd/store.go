@@ -0,0 +1,310 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	mvccpbv3 "go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// listPageSize is the number of keys requested per Get call when an
+// etcdStore paginates through a prefix range with WithRange and WithLimit.
+const listPageSize = 1000
+
+// Store abstracts over where auger reads etcd's mvcc key/value records
+// from: an offline boltdb '.db' file, or a live etcd cluster. Every method
+// returns data in the same *mvccpb.KeyValue shape regardless of backend,
+// so the encoding/decoding paths in extract.go don't need to know which
+// Store they're talking to.
+type Store interface {
+	// Walk calls f for records whose logical etcd key has the given prefix.
+	// boltStore visits every stored revision of every key in ascending
+	// revision order, and an empty prefix visits every key; etcdStore visits
+	// only the current value of each key, in key order, and an empty prefix
+	// falls back to its --etcd-prefix. Iteration stops early if f returns
+	// done=true.
+	Walk(prefix string, f func(kv *mvccpb.KeyValue) (bool, error)) error
+
+	// ListVersions returns the versions recorded for key.
+	ListVersions(key string) ([]int64, error)
+
+	// GetValue returns the value stored for key at the given version.
+	GetValue(key string, version int64) ([]byte, error)
+
+	// Close releases any resources (file handles, connections) held by the store.
+	Close() error
+}
+
+// newStore builds the Store implied by opts: an etcdStore if --endpoints
+// was given, otherwise the default offline boltStore.
+func newStore(opts *extractOptions) (Store, error) {
+	if len(opts.endpoints) > 0 {
+		return newEtcdStore(opts)
+	}
+	return &boltStore{filename: opts.filename}, nil
+}
+
+// boltStore reads etcd's mvcc key/value records directly out of an
+// offline boltdb '.db' file. Etcd must be stopped, since bolt takes an
+// exclusive lock on the file.
+type boltStore struct {
+	filename string
+}
+
+// See etcd/mvcc/kvstore.go:keyBucketName
+var keyBucket = []byte("key")
+
+func (s *boltStore) Walk(prefix string, f func(kv *mvccpb.KeyValue) (bool, error)) error {
+	db, err := bolt.Open(s.filename, 0400, &bolt.Options{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	prefixBytes := []byte(prefix)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keyBucket)
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			kv := &mvccpb.KeyValue{}
+			if err := kv.Unmarshal(v); err != nil {
+				return err
+			}
+			if len(prefixBytes) > 0 && !hasPrefix(kv.Key, prefixBytes) {
+				continue
+			}
+			done, err := f(kv)
+			if err != nil {
+				return fmt.Errorf("Error handling key %s", kv.Key)
+			}
+			if done {
+				break
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *boltStore) ListVersions(key string) ([]int64, error) {
+	var result []int64
+	err := s.Walk(key, func(kv *mvccpb.KeyValue) (bool, error) {
+		if string(kv.Key) == key {
+			result = append(result, kv.Version)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *boltStore) GetValue(key string, version int64) ([]byte, error) {
+	kv, err := s.GetKeyValue(key, version)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+// GetKeyValue returns the full mvcc record stored for key at the given
+// version, not just its value. It's used by callers, like patch.go, that
+// need the record's other fields (CreateRevision, Lease, etc.) in order to
+// write a new revision derived from it.
+func (s *boltStore) GetKeyValue(key string, version int64) (*mvccpb.KeyValue, error) {
+	var result *mvccpb.KeyValue
+	err := s.Walk(key, func(kv *mvccpb.KeyValue) (bool, error) {
+		if string(kv.Key) == key && kv.Version == version {
+			result = kv
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, fmt.Errorf("key not found: %s", key)
+	}
+	return result, nil
+}
+
+func (s *boltStore) Close() error {
+	return nil
+}
+
+func hasPrefix(key, prefix []byte) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// etcdStore reads etcd's mvcc key/value records from a live etcd v3
+// cluster via the client API, so auger can be used for live debugging
+// without stopping etcd. Unlike boltStore, it only sees the current value
+// of each key: earlier revisions are not read, even where etcd hasn't yet
+// compacted them away, and ListVersions reflects only the current Version
+// counter etcd reports.
+type etcdStore struct {
+	client *clientv3.Client
+	prefix string
+}
+
+func newEtcdStore(opts *extractOptions) (*etcdStore, error) {
+	tlsConfig, err := etcdTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.endpoints,
+		DialTimeout: 5 * time.Second,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to etcd endpoints %v: %s", opts.endpoints, err)
+	}
+	return &etcdStore{client: client, prefix: opts.etcdPrefix}, nil
+}
+
+func etcdTLSConfig(opts *extractOptions) (*tls.Config, error) {
+	if opts.cacert == "" && opts.cert == "" && opts.tlsKey == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if opts.cacert != "" {
+		caPEM, err := ioutil.ReadFile(opts.cacert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read --cacert %s: %s", opts.cacert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("unable to parse --cacert %s", opts.cacert)
+		}
+		cfg.RootCAs = pool
+	}
+	if opts.cert != "" || opts.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.cert, opts.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load --cert/--tls-key pair: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (s *etcdStore) Walk(prefix string, f func(kv *mvccpb.KeyValue) (bool, error)) error {
+	ctx := context.Background()
+	effectivePrefix := prefix
+	if effectivePrefix == "" {
+		effectivePrefix = s.prefix
+	}
+	rangeEnd := clientv3.GetPrefixRangeEnd(effectivePrefix)
+	fromKey := effectivePrefix
+	for {
+		// fromKey..rangeEnd is already a bounded range scan covering the
+		// prefix; WithFromKey must not be added here too, since it widens
+		// the range end to "rest of keyspace" and would override rangeEnd,
+		// making pagination run past the prefix.
+		resp, err := s.client.Get(ctx, fromKey, clientv3.WithRange(rangeEnd), clientv3.WithLimit(listPageSize))
+		if err != nil {
+			return fmt.Errorf("etcd Get %s: %s", effectivePrefix, err)
+		}
+		for _, kv := range resp.Kvs {
+			done, err := f(toMvccKeyValue(kv))
+			if err != nil {
+				return fmt.Errorf("Error handling key %s", kv.Key)
+			}
+			if done {
+				return nil
+			}
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return nil
+		}
+		// Paginate from just past the last key seen.
+		fromKey = string(append(append([]byte{}, resp.Kvs[len(resp.Kvs)-1].Key...), 0))
+	}
+}
+
+func (s *etcdStore) ListVersions(key string) ([]int64, error) {
+	resp, err := s.client.Get(context.Background(), key)
+	if err != nil {
+		return nil, fmt.Errorf("etcd Get %s: %s", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return []int64{resp.Kvs[0].Version}, nil
+}
+
+// GetValue only supports the current version of key. A live etcd cluster
+// exposes a key's per-revision mvcc Version counter (what ListVersions
+// returns), not the store-wide revision that WithRev addresses, and those
+// two numbers aren't interchangeable; there is no live-cluster API that
+// maps one to the other without also tracking every historical revision
+// ourselves. Asking for anything but the current version is therefore
+// rejected rather than silently returning the wrong value - use the
+// offline boltdb mode to inspect historical versions.
+func (s *etcdStore) GetValue(key string, version int64) ([]byte, error) {
+	resp, err := s.client.Get(context.Background(), key)
+	if err != nil {
+		return nil, fmt.Errorf("etcd Get %s: %s", key, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("key not found: %s", key)
+	}
+	kv := resp.Kvs[0]
+	if version != 0 && version != kv.Version {
+		return nil, fmt.Errorf("version %d of key %s is not available from a live etcd endpoint, only the current version (%d) is; use the offline boltdb mode to inspect historical versions", version, key, kv.Version)
+	}
+	return kv.Value, nil
+}
+
+func (s *etcdStore) Close() error {
+	return s.client.Close()
+}
+
+// toMvccKeyValue converts a clientv3 KeyValue (go.etcd.io/etcd/api/v3/mvccpb)
+// into this tool's mvccpb.KeyValue (github.com/coreos/etcd/mvcc/mvccpb), so
+// that callers see the same shape regardless of backend.
+func toMvccKeyValue(kv *mvccpbv3.KeyValue) *mvccpb.KeyValue {
+	return &mvccpb.KeyValue{
+		Key:            kv.Key,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Value:          kv.Value,
+		Lease:          kv.Lease,
+	}
+}
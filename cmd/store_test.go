@@ -0,0 +1,58 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"testing"
+
+	mvccpbv3 "go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+func TestHasPrefix(t *testing.T) {
+	cases := []struct {
+		key    string
+		prefix string
+		want   bool
+	}{
+		{"/registry/pods/default/foo", "/registry/pods/", true},
+		{"/registry/pods/default/foo", "/registry/services/", false},
+		{"/registry", "/registry/pods/", false},
+		{"/registry/pods", "", true},
+	}
+	for _, c := range cases {
+		if got := hasPrefix([]byte(c.key), []byte(c.prefix)); got != c.want {
+			t.Errorf("hasPrefix(%q, %q) = %v, want %v", c.key, c.prefix, got, c.want)
+		}
+	}
+}
+
+func TestToMvccKeyValue(t *testing.T) {
+	in := &mvccpbv3.KeyValue{
+		Key:            []byte("/registry/pods/default/foo"),
+		CreateRevision: 1,
+		ModRevision:    3,
+		Version:        2,
+		Value:          []byte("value"),
+		Lease:          42,
+	}
+	out := toMvccKeyValue(in)
+	if string(out.Key) != string(in.Key) || out.CreateRevision != in.CreateRevision ||
+		out.ModRevision != in.ModRevision || out.Version != in.Version ||
+		string(out.Value) != string(in.Value) || out.Lease != in.Lease {
+		t.Errorf("toMvccKeyValue(%+v) = %+v, fields do not match", in, out)
+	}
+}
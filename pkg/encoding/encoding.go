@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encoding decodes the serialized Kubernetes objects etcd stores as
+// values (json, yaml or Kubernetes' protobuf wire format) and re-encodes
+// them, optionally converting to a different GroupVersion along the way.
+package encoding
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+)
+
+// Media types auger knows how to read and write a Kubernetes object as.
+const (
+	JsonMediaType  = "application/json"
+	YamlMediaType  = "application/yaml"
+	ProtoMediaType = "application/vnd.kubernetes.protobuf"
+)
+
+// Scheme is the set of Kubernetes API types auger can decode, convert
+// between versions of, and re-encode. It's the same scheme client-go (and
+// therefore kubectl) links against, so auger understands every built in
+// type out of the box without having to hand-register anything. It's a
+// client scheme, though: it registers the external versions of each type
+// but no internal versions and no conversion functions between versions,
+// neither within a group (e.g. autoscaling/v1 -> autoscaling/v2) nor
+// across groups (e.g. extensions/v1beta1 -> apps/v1). Objects are decoded
+// as the version they were stored as, and ConvertTo returns an error for
+// any target GroupVersion other than that one.
+var Scheme = clientgoscheme.Scheme
+
+// codecs is the NegotiatedSerializer ConvertTo and Convert use to decode
+// and re-encode objects; it's built once from Scheme so proto/json/yaml
+// serializers all agree on the same set of registered types.
+var codecs = serializer.NewCodecFactory(Scheme)
+
+// protobufMagic is the 4 byte prefix Kubernetes' protobuf serializer
+// writes ahead of every value it encodes, so a stream can be identified
+// as protobuf before it's decoded. See
+// k8s.io/apimachinery/pkg/runtime/serializer/protobuf.
+var protobufMagic = []byte{0x6b, 0x38, 0x73, 0x00}
+
+// ToMediaType maps the short output format names auger's --output flag
+// accepts to the media type constants above.
+func ToMediaType(format string) (string, error) {
+	switch format {
+	case "json":
+		return JsonMediaType, nil
+	case "yaml", "":
+		return YamlMediaType, nil
+	case "proto", "protobuf":
+		return ProtoMediaType, nil
+	default:
+		return "", fmt.Errorf("unrecognized format %q, must be one of: json|yaml|proto", format)
+	}
+}
+
+// DetectAndExtract sniffs which media type in is encoded as. in is
+// returned unchanged; detection only inspects its leading bytes (the
+// protobuf magic prefix, or a leading '{' for json), it doesn't decode
+// anything.
+func DetectAndExtract(in []byte) (string, []byte, error) {
+	if bytes.HasPrefix(in, protobufMagic) {
+		return ProtoMediaType, in, nil
+	}
+	trimmed := bytes.TrimSpace(in)
+	if len(trimmed) == 0 {
+		return "", nil, fmt.Errorf("0 byte value, nothing to decode")
+	}
+	if trimmed[0] == '{' {
+		return JsonMediaType, in, nil
+	}
+	return YamlMediaType, in, nil
+}
+
+// Convert decodes in (encoded as inMediaType) and re-encodes it as
+// outMediaType in the GroupVersion it was stored as, returning the
+// TypeMeta of the decoded object.
+func Convert(inMediaType, outMediaType string, in []byte, out io.Writer) (*runtime.TypeMeta, error) {
+	obj, gvk, err := decode(inMediaType, in)
+	if err != nil {
+		return nil, err
+	}
+	if err := encodeAs(obj, gvk.GroupVersion(), outMediaType, out); err != nil {
+		return nil, err
+	}
+	return &runtime.TypeMeta{APIVersion: gvk.GroupVersion().String(), Kind: gvk.Kind}, nil
+}
+
+// ConvertTo decodes in (encoded as inMediaType), encodes it as gv in
+// outMediaType, and returns the TypeMeta of the object as emitted, i.e.
+// with gv. Since Scheme registers no conversions between versions, this
+// only succeeds when gv is the GroupVersion the object was stored as; for
+// any other gv it returns an error rather than falling back to the stored
+// form.
+func ConvertTo(inMediaType, outMediaType string, gv schema.GroupVersion, in []byte, out io.Writer) (*runtime.TypeMeta, error) {
+	obj, gvk, err := decode(inMediaType, in)
+	if err != nil {
+		return nil, err
+	}
+	targetGVK := gv.WithKind(gvk.Kind)
+	if !Scheme.Recognizes(targetGVK) {
+		return nil, fmt.Errorf("no %s registered for %s, can't convert %s", targetGVK.Kind, gv, gvk)
+	}
+	if err := encodeAs(obj, gv, outMediaType, out); err != nil {
+		return nil, fmt.Errorf("unable to convert %s to %s: %s", gvk, gv, err)
+	}
+	return &runtime.TypeMeta{APIVersion: gv.String(), Kind: gvk.Kind}, nil
+}
+
+// decode deserializes in (encoded as inMediaType) into the Go type Scheme
+// registers for the GroupVersionKind its stored TypeMeta names, without
+// converting it, returning both the object and that GroupVersionKind.
+func decode(inMediaType string, in []byte) (runtime.Object, *schema.GroupVersionKind, error) {
+	info, err := serializerInfo(inMediaType)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, gvk, err := info.Serializer.Decode(in, nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decode %s value: %s", inMediaType, err)
+	}
+	return obj, gvk, nil
+}
+
+// encodeAs serializes obj as outMediaType, converting it to gv first.
+func encodeAs(obj runtime.Object, gv schema.GroupVersion, outMediaType string, out io.Writer) error {
+	info, err := serializerInfo(outMediaType)
+	if err != nil {
+		return err
+	}
+	encoder := codecs.EncoderForVersion(info.Serializer, gv)
+	if err := encoder.Encode(obj, out); err != nil {
+		return fmt.Errorf("unable to encode as %s: %s", outMediaType, err)
+	}
+	return nil
+}
+
+func serializerInfo(mediaType string) (runtime.SerializerInfo, error) {
+	info, ok := runtime.SerializerInfoForMediaType(codecs.SupportedMediaTypes(), mediaType)
+	if !ok {
+		return runtime.SerializerInfo{}, fmt.Errorf("no serializer registered for media type %q", mediaType)
+	}
+	return info, nil
+}
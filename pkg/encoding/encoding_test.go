@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encoding
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const testDeployment = `{
+  "apiVersion": "apps/v1",
+  "kind": "Deployment",
+  "metadata": {"name": "test"},
+  "spec": {
+    "selector": {"matchLabels": {"app": "x"}},
+    "template": {
+      "metadata": {"labels": {"app": "x"}},
+      "spec": {"containers": [{"name": "c", "image": "nginx"}]}
+    }
+  }
+}`
+
+func TestConvertToSameVersion(t *testing.T) {
+	out := new(bytes.Buffer)
+	typeMeta, err := ConvertTo(JsonMediaType, JsonMediaType, schema.GroupVersion{Group: "apps", Version: "v1"}, []byte(testDeployment), out)
+	if err != nil {
+		t.Fatalf("ConvertTo: %s", err)
+	}
+	if typeMeta.APIVersion != "apps/v1" || typeMeta.Kind != "Deployment" {
+		t.Errorf("TypeMeta = %+v, want apps/v1 Deployment", typeMeta)
+	}
+	if !strings.Contains(out.String(), `"kind":"Deployment"`) {
+		t.Errorf("ConvertTo output missing kind: %s", out.String())
+	}
+}
+
+func TestConvertToUnregisteredGroupErrors(t *testing.T) {
+	out := new(bytes.Buffer)
+	_, err := ConvertTo(JsonMediaType, JsonMediaType, schema.GroupVersion{Group: "bogus.example.com", Version: "v1"}, []byte(testDeployment), out)
+	if err == nil {
+		t.Fatal("expected ConvertTo to reject an unregistered target group, got nil error")
+	}
+}
+
+func TestConvertJsonRoundTrip(t *testing.T) {
+	out := new(bytes.Buffer)
+	typeMeta, err := Convert(JsonMediaType, JsonMediaType, []byte(testDeployment), out)
+	if err != nil {
+		t.Fatalf("Convert: %s", err)
+	}
+	if typeMeta.APIVersion != "apps/v1" || typeMeta.Kind != "Deployment" {
+		t.Errorf("TypeMeta = %+v, want apps/v1 Deployment", typeMeta)
+	}
+	if !strings.Contains(out.String(), `"name":"test"`) {
+		t.Errorf("Convert output missing metadata.name: %s", out.String())
+	}
+}
+
+func TestDetectAndExtract(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"json", []byte(`{"kind":"Pod"}`), JsonMediaType},
+		{"yaml", []byte("kind: Pod\n"), YamlMediaType},
+		{"proto", append([]byte{0x6b, 0x38, 0x73, 0x00}, []byte("...")...), ProtoMediaType},
+	}
+	for _, c := range cases {
+		got, out, err := DetectAndExtract(c.in)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("%s: DetectAndExtract media type = %q, want %q", c.name, got, c.want)
+		}
+		if !bytes.Equal(out, c.in) {
+			t.Errorf("%s: DetectAndExtract returned %q, want input unchanged", c.name, out)
+		}
+	}
+}
+
+func TestToMediaType(t *testing.T) {
+	cases := map[string]string{"json": JsonMediaType, "yaml": YamlMediaType, "": YamlMediaType, "proto": ProtoMediaType}
+	for format, want := range cases {
+		got, err := ToMediaType(format)
+		if err != nil {
+			t.Fatalf("ToMediaType(%q): %s", format, err)
+		}
+		if got != want {
+			t.Errorf("ToMediaType(%q) = %q, want %q", format, got, want)
+		}
+	}
+	if _, err := ToMediaType("xml"); err == nil {
+		t.Error("expected ToMediaType(\"xml\") to error")
+	}
+}
@@ -0,0 +1,321 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption decodes etcd values that have been wrapped by
+// Kubernetes' apiserver encryption-at-rest providers, so that tools
+// working directly against etcd's on disk state can recover the
+// cleartext Kubernetes object underneath.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v2"
+)
+
+// Prefix is the envelope prefix kube-apiserver writes in front of every
+// value encrypted by an encryption-at-rest provider, e.g.
+// "k8s:enc:aescbc:v1:key1:<ciphertext>".
+const Prefix = "k8s:enc:"
+
+// Config mirrors the subset of apiserver.config.k8s.io/v1
+// EncryptionConfiguration that auger needs in order to decrypt values: the
+// ordered list of providers configured for each resource. The resources
+// each entry lists are parsed but not used; auger doesn't care which
+// resources a provider applies to, since the envelope prefix already
+// identifies the provider and key used to write a given value.
+type Config struct {
+	Resources []ResourceConfig `yaml:"resources"`
+
+	// kmsServices caches one KMSService per configured kms provider,
+	// dialed lazily the first time a matching envelope is decrypted.
+	kmsServices map[string]KMSService
+}
+
+// kmsService returns the KMSService for cfg, dialing it on first use.
+func (c *Config) kmsService(cfg *KMSConfig) (KMSService, error) {
+	if c.kmsServices == nil {
+		c.kmsServices = map[string]KMSService{}
+	}
+	if svc, ok := c.kmsServices[cfg.Name]; ok {
+		return svc, nil
+	}
+	timeout := 3 * time.Second
+	if cfg.Timeout != "" {
+		if d, err := time.ParseDuration(cfg.Timeout); err == nil {
+			timeout = d
+		}
+	}
+	svc, err := NewKMSClient(cfg.Endpoint, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.kmsServices[cfg.Name] = svc
+	return svc, nil
+}
+
+// ResourceConfig is one entry of Config.Resources.
+type ResourceConfig struct {
+	Resources []string         `yaml:"resources"`
+	Providers []ProviderConfig `yaml:"providers"`
+}
+
+// ProviderConfig is one entry of ResourceConfig.Providers. Exactly one of
+// its fields is expected to be set, matching the EncryptionConfiguration
+// schema.
+type ProviderConfig struct {
+	AESGCM    *AESConfig       `yaml:"aesgcm,omitempty"`
+	AESCBC    *AESConfig       `yaml:"aescbc,omitempty"`
+	Secretbox *SecretboxConfig `yaml:"secretbox,omitempty"`
+	KMS       *KMSConfig       `yaml:"kms,omitempty"`
+	Identity  *struct{}        `yaml:"identity,omitempty"`
+}
+
+// AESConfig holds the named 32-byte keys used by the aescbc and aesgcm
+// providers.
+type AESConfig struct {
+	Keys []NamedKey `yaml:"keys"`
+}
+
+// SecretboxConfig holds the named keys used by the secretbox provider.
+type SecretboxConfig struct {
+	Keys []NamedKey `yaml:"keys"`
+}
+
+// KMSConfig identifies the KMS plugin a kms provider talks to.
+type KMSConfig struct {
+	Name      string `yaml:"name"`
+	Endpoint  string `yaml:"endpoint"`
+	CacheSize int    `yaml:"cachesize"`
+	Timeout   string `yaml:"timeout"`
+}
+
+// NamedKey is a base64-encoded key with the name kube-apiserver writes
+// into the envelope prefix, e.g. "k8s:enc:aescbc:v1:key1:...".
+type NamedKey struct {
+	Name   string `yaml:"name"`
+	Secret string `yaml:"secret"`
+}
+
+// LoadConfig reads and parses an EncryptionConfiguration file as produced
+// for kube-apiserver's --encryption-provider-config flag.
+func LoadConfig(filename string) (*Config, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read encryption config %s: %s", filename, err)
+	}
+	cfg := &Config{}
+	if err := yaml.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse encryption config %s: %s", filename, err)
+	}
+	return cfg, nil
+}
+
+// IsEncrypted reports whether in is wrapped in a k8s:enc: envelope.
+func IsEncrypted(in []byte) bool {
+	return bytes.HasPrefix(in, []byte(Prefix))
+}
+
+// ProviderAndKeyName parses the provider and key name out of a k8s:enc:
+// envelope without decrypting it, for inventory purposes (e.g.
+// --print-encryption-provider). kms envelopes report the key id found in
+// their length-prefixed header (see decodeKMSEnvelope) as the key name.
+func ProviderAndKeyName(in []byte) (provider string, keyName string, err error) {
+	if !IsEncrypted(in) {
+		return "", "", fmt.Errorf("value is not a k8s:enc: envelope")
+	}
+	rest := in[len(Prefix):]
+	parts := bytes.SplitN(rest, []byte(":"), 3)
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("malformed k8s:enc: envelope: %q", in)
+	}
+	provider = string(parts[0])
+	if provider == "identity" || len(parts) < 3 {
+		return provider, "", nil
+	}
+	switch provider {
+	case "kms":
+		env, err := decodeKMSEnvelope(parts[2])
+		if err != nil {
+			return provider, "", err
+		}
+		return provider, env.KeyID, nil
+	default:
+		idx := bytes.IndexByte(parts[2], ':')
+		if idx < 0 {
+			return provider, "", fmt.Errorf("malformed envelope payload")
+		}
+		return provider, string(parts[2][:idx]), nil
+	}
+}
+
+// Decrypt unwraps a k8s:enc: envelope, trying each matching provider's keys
+// in the order they appear in the Config, mirroring the order
+// kube-apiserver itself uses when rotating keys. It returns the cleartext
+// bytes that would normally be fed to encoding.DetectAndExtract.
+func (c *Config) Decrypt(in []byte) ([]byte, error) {
+	if !IsEncrypted(in) {
+		return nil, fmt.Errorf("value is not a k8s:enc: envelope")
+	}
+	rest := in[len(Prefix):]
+	parts := bytes.SplitN(rest, []byte(":"), 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("malformed k8s:enc: envelope: %q", in)
+	}
+	providerName := string(parts[0])
+	// parts[1] is the envelope version, e.g. "v1"; the remainder is
+	// "<keyname>:<ciphertext>" for aescbc/aesgcm/secretbox, or the raw
+	// kms payload for kms providers.
+	var keyAndPayload []byte
+	if len(parts) == 3 {
+		keyAndPayload = parts[2]
+	}
+
+	for _, rc := range c.Resources {
+		for _, p := range rc.Providers {
+			switch providerName {
+			case "identity":
+				if p.Identity != nil {
+					return keyAndPayload, nil
+				}
+			case "aescbc":
+				if p.AESCBC != nil {
+					if out, err := decryptNamed(p.AESCBC.Keys, keyAndPayload, decryptAESCBC); err == nil {
+						return out, nil
+					}
+				}
+			case "aesgcm":
+				if p.AESGCM != nil {
+					if out, err := decryptNamed(p.AESGCM.Keys, keyAndPayload, decryptAESGCM); err == nil {
+						return out, nil
+					}
+				}
+			case "secretbox":
+				if p.Secretbox != nil {
+					if out, err := decryptNamed(p.Secretbox.Keys, keyAndPayload, decryptSecretbox); err == nil {
+						return out, nil
+					}
+				}
+			case "kms":
+				if p.KMS != nil {
+					svc, err := c.kmsService(p.KMS)
+					if err != nil {
+						return nil, err
+					}
+					if out, err := DecryptKMS(context.Background(), svc, keyAndPayload); err == nil {
+						return out, nil
+					}
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no configured key could decrypt envelope for provider %q", providerName)
+}
+
+// decryptNamed splits "<keyname>:<ciphertext>", finds the matching key by
+// name and decrypts with it, returning an error if the name isn't
+// configured or decryption fails.
+func decryptNamed(keys []NamedKey, keyAndPayload []byte, decrypt func(key, ciphertext []byte) ([]byte, error)) ([]byte, error) {
+	idx := bytes.IndexByte(keyAndPayload, ':')
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed envelope payload")
+	}
+	name := string(keyAndPayload[:idx])
+	ciphertext := keyAndPayload[idx+1:]
+	for _, k := range keys {
+		if k.Name != name {
+			continue
+		}
+		key, err := decodeKey(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return decrypt(key, ciphertext)
+	}
+	return nil, fmt.Errorf("no key named %q configured", name)
+}
+
+func decryptAESCBC(key, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, fmt.Errorf("aescbc ciphertext too short")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("aescbc ciphertext is not a multiple of the block size")
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+	return pkcs7Unpad(plain)
+}
+
+func decryptAESGCM(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("aesgcm ciphertext too short")
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	ciphertext = ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func decryptSecretbox(key, ciphertext []byte) ([]byte, error) {
+	const nonceSize = 24
+	if len(ciphertext) < nonceSize {
+		return nil, fmt.Errorf("secretbox ciphertext too short")
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], ciphertext[:nonceSize])
+	var keyArr [32]byte
+	if len(key) != len(keyArr) {
+		return nil, fmt.Errorf("secretbox key must be 32 bytes, got %d", len(key))
+	}
+	copy(keyArr[:], key)
+	out, ok := secretbox.Open(nil, ciphertext[nonceSize:], &nonce, &keyArr)
+	if !ok {
+		return nil, fmt.Errorf("secretbox: authentication failed")
+	}
+	return out, nil
+}
+
+func pkcs7Unpad(in []byte) ([]byte, error) {
+	if len(in) == 0 {
+		return nil, fmt.Errorf("pkcs7: empty input")
+	}
+	pad := int(in[len(in)-1])
+	if pad == 0 || pad > len(in) {
+		return nil, fmt.Errorf("pkcs7: invalid padding")
+	}
+	return in[:len(in)-pad], nil
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func TestDecryptAESCBCRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("super secret payload")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded, err := pkcs7Pad(plain, aes.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	got, err := decryptAESCBC(key, append(iv, ciphertext...))
+	if err != nil {
+		t.Fatalf("decryptAESCBC: %s", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decryptAESCBC = %q, want %q", got, plain)
+	}
+}
+
+func TestDecryptAESGCMRoundTrip(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("super secret payload")
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := aead.Seal(nil, nonce, plain, nil)
+
+	got, err := decryptAESGCM(key, append(nonce, ciphertext...))
+	if err != nil {
+		t.Fatalf("decryptAESGCM: %s", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decryptAESGCM = %q, want %q", got, plain)
+	}
+}
+
+func TestDecryptSecretboxRoundTrip(t *testing.T) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte("super secret payload")
+	ciphertext := secretbox.Seal(nonce[:], plain, &nonce, &key)
+
+	got, err := decryptSecretbox(key[:], ciphertext)
+	if err != nil {
+		t.Fatalf("decryptSecretbox: %s", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("decryptSecretbox = %q, want %q", got, plain)
+	}
+}
+
+func TestConfigDecryptAESGCM(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"kind":"Secret"}`)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := aead.Seal(nil, nonce, plain, nil)
+
+	cfg := &Config{
+		Resources: []ResourceConfig{
+			{
+				Providers: []ProviderConfig{
+					{AESGCM: &AESConfig{Keys: []NamedKey{
+						{Name: "key1", Secret: base64.StdEncoding.EncodeToString(key)},
+					}}},
+				},
+			},
+		},
+	}
+	envelope := append([]byte(Prefix+"aesgcm:v1:key1:"), append(nonce, ciphertext...)...)
+
+	got, err := cfg.Decrypt(envelope)
+	if err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Errorf("Decrypt = %q, want %q", got, plain)
+	}
+}
+
+func TestNewKMSClientDialError(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewKMSClient("unix://"+dir+"/no-such.sock", 50*time.Millisecond); err == nil {
+		t.Fatal("expected NewKMSClient to fail dialing a socket nothing is listening on")
+	}
+}
+
+func pkcs7Pad(in []byte, blockSize int) ([]byte, error) {
+	if blockSize <= 0 || blockSize > 255 {
+		return nil, fmt.Errorf("pkcs7: invalid block size %d", blockSize)
+	}
+	pad := blockSize - len(in)%blockSize
+	return append(append([]byte{}, in...), bytes.Repeat([]byte{byte(pad)}, pad)...), nil
+}
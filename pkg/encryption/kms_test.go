@@ -0,0 +1,91 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// fakeKMSPlugin is a minimal v1beta1 KMS plugin server, just enough to
+// exercise grpcKMSClient's hand-rolled request/response (en|de)coding
+// end to end over a real unix socket and gRPC connection.
+type fakeKMSPlugin struct{}
+
+func (fakeKMSPlugin) Decrypt(ctx context.Context, req *kmsBytesMessage) (*kmsBytesMessage, error) {
+	return &kmsBytesMessage{value: append([]byte("decrypted:"), req.value...)}, nil
+}
+
+type fakeKMSPluginServer interface {
+	Decrypt(context.Context, *kmsBytesMessage) (*kmsBytesMessage, error)
+}
+
+var fakeKMSServiceDesc = grpc.ServiceDesc{
+	ServiceName: "v1beta1.KeyManagementService",
+	HandlerType: (*fakeKMSPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Decrypt",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &kmsBytesMessage{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(fakeKMSPluginServer).Decrypt(ctx, req)
+			},
+		},
+	},
+}
+
+func TestGRPCKMSClientDecrypt(t *testing.T) {
+	sockPath := t.TempDir() + "/kms.sock"
+	lis, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&fakeKMSServiceDesc, fakeKMSPlugin{})
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.DialContext(context.Background(), "passthrough:///"+sockPath,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sockPath)
+		}),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer conn.Close()
+
+	client := &grpcKMSClient{conn: conn}
+	got, err := client.Decrypt(context.Background(), "key1", []byte("ciphertext"))
+	if err != nil {
+		t.Fatalf("Decrypt: %s", err)
+	}
+	if want := []byte("decrypted:ciphertext"); !bytes.Equal(got, want) {
+		t.Errorf("Decrypt = %q, want %q", got, want)
+	}
+}